@@ -0,0 +1,246 @@
+//go:build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/idtools"
+	"github.com/opencontainers/image-spec/identity"
+	"golang.org/x/sys/unix"
+)
+
+// WithIdmappedSnapshot prepares a snapshot of the image and shifts its
+// ownership by attaching an idmapped mount (Linux 5.12+, MOUNT_ATTR_IDMAP)
+// directly to it, rather than computing and applying
+// idtools.IdentityMapping.ToHost per file the way withRemappedSnapshotBase
+// does. This touches the filesystem itself not at all -- no walk, no chown,
+// no second physical copy of the snapshot -- so unlike an earlier version of
+// this function there's no base snapshot to Prepare/Commit/cache: idmapping
+// a bind mount in place is already cheap enough to redo for every container.
+//
+// This only applies when the prepared snapshot is a single bind mount (as
+// e.g. the native snapshotter returns) -- an overlay mount's lowerdir/
+// upperdir options are consumed fresh by the runtime at container start, so
+// idmapping whatever happens to be mounted at those paths on the host
+// wouldn't affect the container's view at all. When the snapshot isn't a
+// bind mount, or the kernel doesn't support idmapped mounts, this falls back
+// to the chown-based withRemappedSnapshotBase.
+func WithIdmappedSnapshot(id string, i Image, idmap idtools.IdentityMapping) NewContainerOpts {
+	return func(ctx context.Context, client *Client, c *containers.Container) error {
+		if !idmapMountsSupported() {
+			return withRemappedSnapshotBase(id, i, idmap, false)(ctx, client, c)
+		}
+
+		diffIDs, err := i.(*image).i.RootFS(ctx, client.ContentStore(), client.platform)
+		if err != nil {
+			return err
+		}
+		parent := identity.ChainID(diffIDs).String()
+
+		c.Snapshotter, err = client.resolveSnapshotterName(ctx, c.Snapshotter)
+		if err != nil {
+			return err
+		}
+		snapshotter, err := client.getSnapshotter(ctx, c.Snapshotter)
+		if err != nil {
+			return err
+		}
+
+		mounts, err := snapshotter.Prepare(ctx, id, parent)
+		if err != nil {
+			return err
+		}
+		if err := idmapMountInPlace(mounts, idmap); err != nil {
+			log.G(ctx).WithError(err).Debug("idmapped mount unavailable, falling back to chown-based remap")
+			snapshotter.Remove(ctx, id)
+			return withRemappedSnapshotBase(id, i, idmap, false)(ctx, client, c)
+		}
+
+		c.SnapshotKey = id
+		c.Image = i.Name()
+		return nil
+	}
+}
+
+// idmapMountsSupported probes whether the running kernel understands
+// MOUNT_ATTR_IDMAP, similar to the probes overlay uses for its own feature
+// detection: attempt the operation against a throwaway mount and treat any
+// failure as "unsupported" rather than a hard error.
+func idmapMountsSupported() bool {
+	treeFd, err := unix.OpenTree(unix.AT_FDCWD, os.TempDir(), unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(treeFd)
+
+	userns, closeUserns, err := newIdmapUserns(idtools.IdentityMapping{})
+	if err != nil {
+		return false
+	}
+	defer closeUserns()
+
+	return unix.MountSetattr(treeFd, "", unix.AT_EMPTY_PATH, &unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(userns.Fd()),
+	}) == nil
+}
+
+// idmapMountInPlace applies idmap to mounts' single bind mount by cloning
+// its source directory with OPEN_TREE_CLONE, mount_setattr(2)ing
+// MOUNT_ATTR_IDMAP onto the clone using a throwaway user namespace
+// configured with idmap, and move_mounting that idmapped clone back over the
+// exact same path mounts already points at. Every later bind mount of that
+// path -- which is how the runtime consumes a "bind" snapshot mount --
+// inherits the mapping straight from the kernel, so there's nothing else to
+// apply, persist, or commit: the directory itself is now the final,
+// idmapped rootfs.
+func idmapMountInPlace(mounts []mount.Mount, idmap idtools.IdentityMapping) error {
+	if len(mounts) != 1 || mounts[0].Type != "bind" {
+		return fmt.Errorf("idmapped mount requires a single bind mount, got %d mount(s)", len(mounts))
+	}
+	root := mounts[0].Source
+
+	treeFd, err := unix.OpenTree(unix.AT_FDCWD, root, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+	if err != nil {
+		return fmt.Errorf("open_tree %s: %w", root, err)
+	}
+	defer unix.Close(treeFd)
+
+	userns, closeUserns, err := newIdmapUserns(idmap)
+	if err != nil {
+		return err
+	}
+	defer closeUserns()
+
+	if err := unix.MountSetattr(treeFd, "", unix.AT_EMPTY_PATH, &unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(userns.Fd()),
+	}); err != nil {
+		return fmt.Errorf("mount_setattr MOUNT_ATTR_IDMAP: %w", err)
+	}
+
+	// Attach the idmapped clone directly over root. Closing treeFd
+	// afterward is safe either way: on success the clone is now anchored at
+	// root independently of the fd; on failure the never-attached clone is
+	// simply torn down.
+	if err := unix.MoveMount(treeFd, "", unix.AT_FDCWD, root, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("move_mount onto %s: %w", root, err)
+	}
+	return nil
+}
+
+// idmapHelperArg0 is the argv[0] marker RunIdmapHelperIfRequested looks for.
+// It is passed explicitly as Cmd.Args, never derived from this process's own
+// os.Args[0] or an environment variable, so re-exec doesn't depend on how
+// this binary happened to be invoked (relative path, $PATH lookup, a binary
+// replaced on disk since the daemon started, ...).
+const idmapHelperArg0 = "containerd-idmap-helper"
+
+// RunIdmapHelperIfRequested must be called as the first statement in main()
+// by any binary that uses WithIdmappedSnapshot, mirroring the contract of
+// pkg/reexec's registered-subcommand dispatch: it checks whether this
+// process was re-exec'd (via /proc/self/exe) as the idmap helper, and if so
+// blocks here until the parent closes its stdin and then exits, never
+// returning to the rest of main(). For every other invocation it's a no-op.
+//
+// Dispatch is explicit and opt-in on purpose -- unlike an env-var-triggered
+// package init(), it can't be hit accidentally by a third-party program that
+// happens to import this package, and it doesn't assume anything about how
+// the current binary was invoked.
+func RunIdmapHelperIfRequested() {
+	if len(os.Args) == 0 || os.Args[0] != idmapHelperArg0 {
+		return
+	}
+	io.Copy(io.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+// newIdmapUserns spawns a paused helper process (see
+// RunIdmapHelperIfRequested) in a fresh user namespace, writes idmap into
+// its /proc/<pid>/{uid,gid}_map, and returns an open fd to that namespace
+// for use as MountAttr.Userns_fd. The helper is torn down by the returned
+// close function once the caller is done with the namespace.
+func newIdmapUserns(idmap idtools.IdentityMapping) (nsFile *os.File, closeFn func(), err error) {
+	cmd := &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: []string{idmapHelperArg0},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER,
+		},
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("create idmap helper stdin: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("spawn idmap helper: %w", err)
+	}
+
+	cleanup := func() {
+		stdin.Close()
+		cmd.Wait()
+	}
+
+	if err := os.WriteFile(fmt.Sprintf("/proc/%d/setgroups", cmd.Process.Pid), []byte("deny"), 0o644); err != nil && !os.IsNotExist(err) {
+		cleanup()
+		return nil, nil, fmt.Errorf("deny setgroups for idmap helper: %w", err)
+	}
+	if err := writeIDMap(cmd.Process.Pid, "uid_map", idmap.UIDMaps); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := writeIDMap(cmd.Process.Pid, "gid_map", idmap.GIDMaps); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	nsFile, err = os.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid))
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("open user namespace of idmap helper: %w", err)
+	}
+
+	return nsFile, func() {
+		nsFile.Close()
+		cleanup()
+	}, nil
+}
+
+func writeIDMap(pid int, file string, idmap []idtools.IDMap) error {
+	if len(idmap) == 0 {
+		// An empty mapping writes nothing, leaving this map of the helper's
+		// user namespace unset.
+		return nil
+	}
+	var lines string
+	for _, m := range idmap {
+		lines += fmt.Sprintf("%d %d %d\n", m.ContainerID, m.HostID, m.Size)
+	}
+	return os.WriteFile(fmt.Sprintf("/proc/%d/%s", pid, file), []byte(lines), 0o644)
+}
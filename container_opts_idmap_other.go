@@ -0,0 +1,35 @@
+//go:build !linux && !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/pkg/idtools"
+)
+
+// WithIdmappedSnapshot is only implemented on Linux (MOUNT_ATTR_IDMAP is a
+// Linux 5.12+ feature); on other non-Windows platforms it falls back to the
+// chown-based withRemappedSnapshotBase. It is not defined on Windows.
+func WithIdmappedSnapshot(id string, i Image, idmap idtools.IdentityMapping) NewContainerOpts {
+	return func(ctx context.Context, client *Client, c *containers.Container) error {
+		return withRemappedSnapshotBase(id, i, idmap, false)(ctx, client, c)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/containerd/pkg/idtools"
+)
+
+// numReflinkBenchFiles matches the scale that motivated tryReflinkRemap: a
+// synthetic image layer large enough that a full merged-view Lchown walk
+// (remapTree in container_opts_unix.go, which tryReflinkRemap bypasses
+// entirely for overlay mounts whose upperdir supports reflink) visibly
+// dominates wall-clock time.
+const numReflinkBenchFiles = 500_000
+
+var reflinkBenchMapping = idtools.IdentityMapping{
+	UIDMaps: []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	GIDMaps: []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+}
+
+// buildReflinkBenchLayer populates dir with numReflinkBenchFiles files, all
+// owned by the benchmark process's uid/gid (0 when run as root, as the
+// Lchown calls need), which reflinkBenchMapping shifts, so every one of them
+// needs remapping and gets copied up.
+func buildReflinkBenchLayer(b *testing.B, dir string) {
+	b.Helper()
+	for i := 0; i < numReflinkBenchFiles; i++ {
+		sub := filepath.Join(dir, strconv.Itoa(i/1000))
+		if err := os.MkdirAll(sub, 0o755); err != nil {
+			b.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(sub, strconv.Itoa(i)), nil, 0o644); err != nil {
+			b.Fatalf("write: %v", err)
+		}
+	}
+}
+
+// BenchmarkRemapOverlayLayersReflink measures remapOverlayLayers -- the
+// lower-layer-only walk plus reflinkCopy copy-up that tryReflinkRemap uses --
+// against a synthetic single-layer image of numReflinkBenchFiles files. It
+// measures the fast path alone; no remapTree walk of the same tree is
+// benchmarked here to compare it against.
+func BenchmarkRemapOverlayLayersReflink(b *testing.B) {
+	lower := b.TempDir()
+	buildReflinkBenchLayer(b, lower)
+	cfg := newRemapConfig(nil)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		upper := b.TempDir()
+		if err := remapOverlayLayers([]string{lower}, upper, reflinkBenchMapping, cfg); err != nil {
+			b.Fatalf("remapOverlayLayers: %v", err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+//go:build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/idtools"
+	"golang.org/x/sys/unix"
+)
+
+// tryReflinkRemap enumerates an overlayfs mount's lower layers directly
+// instead of walking the merged view, and only materializes a file into the
+// upper dir -- via a cheap FICLONE/copy_file_range reflink rather than
+// letting a chown on the merged view force a full overlay copy-up -- when
+// its owner actually needs to change under idmap. Entries that are already
+// correctly owned are left untouched in the lower layer entirely.
+//
+// handled is false (falling back to the merged-view walk in remapRootFS)
+// whenever the mount isn't overlayfs, or isn't on a filesystem that supports
+// reflink, so native and non-reflink-capable overlay upperdirs keep working
+// exactly as before.
+func tryReflinkRemap(mounts []mount.Mount, idmap idtools.IdentityMapping, cfg *remapConfig) (handled bool, err error) {
+	lower, upper, ok := overlayDirs(mounts)
+	if !ok || !reflinkSupported(upper) {
+		return false, nil
+	}
+	return true, remapOverlayLayers(lower, upper, idmap, cfg)
+}
+
+// overlayDirs extracts the lowerdir chain and upperdir out of an overlayfs
+// mount's options, if present.
+func overlayDirs(mounts []mount.Mount) (lower []string, upper string, ok bool) {
+	if len(mounts) != 1 || mounts[0].Type != "overlay" {
+		return nil, "", false
+	}
+	for _, o := range mounts[0].Options {
+		switch {
+		case strings.HasPrefix(o, "lowerdir="):
+			lower = strings.Split(strings.TrimPrefix(o, "lowerdir="), ":")
+		case strings.HasPrefix(o, "upperdir="):
+			upper = strings.TrimPrefix(o, "upperdir=")
+		}
+	}
+	return lower, upper, upper != "" && len(lower) > 0
+}
+
+// reflinkSupported probes FICLONE against a throwaway file in dir, mirroring
+// the probe overlay's own snapshotter uses for reflink feature detection.
+func reflinkSupported(dir string) bool {
+	src, err := os.CreateTemp(dir, ".reflink-probe-src")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	dst, err := os.CreateTemp(dir, ".reflink-probe-dst")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())) == nil
+}
+
+type remapTask struct {
+	lowerPath string
+	lowerRoot string
+	rel       string
+	info      os.FileInfo
+}
+
+// remapOverlayLayers walks lower (outermost first) deduping by relative path
+// so each file is only visited in the topmost layer that actually has it,
+// and fans the per-file work out across cfg.concurrency workers.
+func remapOverlayLayers(lower []string, upper string, idmap idtools.IdentityMapping, cfg *remapConfig) error {
+	seen := make(map[string]struct{})
+	tasks := make(chan remapTask, cfg.concurrency*2)
+	errs := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				if err := remapLayerEntry(t, upper, idmap); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	var walkErr error
+	for _, dir := range lower {
+		if walkErr != nil {
+			break
+		}
+		walkErr = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if _, dup := seen[rel]; dup {
+				return nil
+			}
+			seen[rel] = struct{}{}
+			select {
+			case tasks <- remapTask{lowerPath: path, lowerRoot: dir, rel: rel, info: info}:
+			case err := <-errs:
+				return err
+			}
+			return nil
+		})
+	}
+	close(tasks)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	return walkErr
+}
+
+func remapLayerEntry(t remapTask, upper string, idmap idtools.IdentityMapping) error {
+	stat, ok := t.info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported stat_t for %s", t.lowerPath)
+	}
+	h, err := idmap.ToHost(idtools.Identity{UID: int(stat.Uid), GID: int(stat.Gid)})
+	if err != nil {
+		return err
+	}
+	if h.UID == int(stat.Uid) && h.GID == int(stat.Gid) {
+		// No copy-up needed at all: leave it in the lower layer.
+		return nil
+	}
+
+	if err := ensureUpperParents(upper, t.lowerRoot, t.rel, idmap); err != nil {
+		return err
+	}
+
+	upperPath := filepath.Join(upper, t.rel)
+	if t.info.IsDir() {
+		// MkdirAll is a no-op if a child entry's own ensureUpperParents call
+		// already created upperPath; re-apply the mode explicitly so this
+		// directory's own remap isn't silently dropped in that case.
+		if err := os.MkdirAll(upperPath, t.info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chmod(upperPath, t.info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Lchown(upperPath, h.UID, h.GID)
+	}
+	if t.info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(t.lowerPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, upperPath); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return os.Lchown(upperPath, h.UID, h.GID)
+	}
+	if err := reflinkCopy(t.lowerPath, upperPath); err != nil {
+		return err
+	}
+	return os.Lchown(upperPath, h.UID, h.GID)
+}
+
+// ensureUpperParents recreates, under upper, every ancestor directory of rel
+// that doesn't already exist there, copying each one's mode and (remapped)
+// ownership from its original entry under lowerRoot -- the lower layer rel
+// was found in -- instead of defaulting to a fixed mode and the current
+// process's uid/gid. Without this, a directory forced into the upper layer
+// only because one of its descendants needs remapping would silently lose
+// its real mode (e.g. sticky /tmp, setgid collaborative dirs, private 0700
+// dirs all flattening to 0755 root:root), the same way remapLayerEntry's own
+// directory case did before it started chowning and chmodding explicitly.
+func ensureUpperParents(upper, lowerRoot, rel string, idmap idtools.IdentityMapping) error {
+	dir := filepath.Dir(rel)
+	if dir == "." || dir == string(filepath.Separator) {
+		return nil
+	}
+	if err := ensureUpperParents(upper, lowerRoot, dir, idmap); err != nil {
+		return err
+	}
+
+	upperDir := filepath.Join(upper, dir)
+	if _, err := os.Lstat(upperDir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	info, err := os.Lstat(filepath.Join(lowerRoot, dir))
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported stat_t for %s", filepath.Join(lowerRoot, dir))
+	}
+	h, err := idmap.ToHost(idtools.Identity{UID: int(stat.Uid), GID: int(stat.Gid)})
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(upperDir, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Chmod(upperDir, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Lchown(upperDir, h.UID, h.GID)
+}
+
+// reflinkCopy copies src to dst sharing extents via FICLONE when the
+// filesystem supports it (btrfs, xfs with reflink=1, zfs), falling back to
+// copy_file_range and then a plain byte copy.
+func reflinkCopy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return nil
+	}
+
+	size := int(info.Size())
+	if n, err := unix.CopyFileRange(int(in.Fd()), nil, int(out.Fd()), nil, size, 0); err == nil && n == size {
+		return nil
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
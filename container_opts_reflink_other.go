@@ -0,0 +1,30 @@
+//go:build !windows && !linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/idtools"
+)
+
+// tryReflinkRemap is a Linux-only (overlayfs/native + FICLONE) fast path; on
+// other platforms remapRootFS always falls back to the merged-view walk.
+func tryReflinkRemap(mounts []mount.Mount, idmap idtools.IdentityMapping, cfg *remapConfig) (handled bool, err error) {
+	return false, nil
+}
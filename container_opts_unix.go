@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"syscall"
 
 	"github.com/containerd/containerd/containers"
@@ -34,7 +36,7 @@ import (
 
 // WithRemappedSnapshot creates a new snapshot and remaps the uid/gid for the
 // filesystem to be used by a container with user namespaces
-func WithRemappedSnapshot(id string, i Image, uid, gid uint32) NewContainerOpts {
+func WithRemappedSnapshot(id string, i Image, uid, gid uint32, opts ...RemapOpt) NewContainerOpts {
 	idmap := idtools.IdentityMapping{
 		UIDMaps: []idtools.IDMap{
 			{
@@ -51,14 +53,14 @@ func WithRemappedSnapshot(id string, i Image, uid, gid uint32) NewContainerOpts
 			},
 		},
 	}
-	return withRemappedSnapshotBase(id, i, idmap, false)
+	return withRemappedSnapshotBase(id, i, idmap, false, opts...)
 }
-func WithMultiRemappedSnapshot(id string, i Image, idmap idtools.IdentityMapping) NewContainerOpts {
-	return withRemappedSnapshotBase(id, i, idmap, false)
+func WithMultiRemappedSnapshot(id string, i Image, idmap idtools.IdentityMapping, opts ...RemapOpt) NewContainerOpts {
+	return withRemappedSnapshotBase(id, i, idmap, false, opts...)
 }
 
 // WithRemappedSnapshotView is similar to WithRemappedSnapshot but rootfs is mounted as read-only.
-func WithRemappedSnapshotView(id string, i Image, uid, gid uint32) NewContainerOpts {
+func WithRemappedSnapshotView(id string, i Image, uid, gid uint32, opts ...RemapOpt) NewContainerOpts {
 	idmap := idtools.IdentityMapping{
 		UIDMaps: []idtools.IDMap{
 			{
@@ -75,13 +77,13 @@ func WithRemappedSnapshotView(id string, i Image, uid, gid uint32) NewContainerO
 			},
 		},
 	}
-	return withRemappedSnapshotBase(id, i, idmap, true)
+	return withRemappedSnapshotBase(id, i, idmap, true, opts...)
 }
-func WithMultiRemappedSnapshotView(id string, i Image, idmap idtools.IdentityMapping) NewContainerOpts {
-	return withRemappedSnapshotBase(id, i, idmap, true)
+func WithMultiRemappedSnapshotView(id string, i Image, idmap idtools.IdentityMapping, opts ...RemapOpt) NewContainerOpts {
+	return withRemappedSnapshotBase(id, i, idmap, true, opts...)
 }
 
-func withRemappedSnapshotBase(id string, i Image, idmap idtools.IdentityMapping, readonly bool) NewContainerOpts {
+func withRemappedSnapshotBase(id string, i Image, idmap idtools.IdentityMapping, readonly bool, opts ...RemapOpt) NewContainerOpts {
 	return func(ctx context.Context, client *Client, c *containers.Container) error {
 		diffIDs, err := i.(*image).i.RootFS(ctx, client.ContentStore(), client.platform)
 		if err != nil {
@@ -100,6 +102,29 @@ func withRemappedSnapshotBase(id string, i Image, idmap idtools.IdentityMapping,
 		if err != nil {
 			return err
 		}
+
+		labelOpt := WithMultiRemapperLabels(idmap)
+		mode, resolvedParent, err := resolveSnapshotOptions(ctx, client, c.Snapshotter, snapshotter, parent, labelOpt)
+		if err != nil {
+			return err
+		}
+		if mode == remapModeLazy {
+			// The snapshotter can materialize shifted ownership on demand as
+			// it streams content in; skip the prepare/remap/commit dance
+			// entirely and let it apply the mapping labels itself.
+			if readonly {
+				_, err = snapshotter.View(ctx, id, resolvedParent, labelOpt)
+			} else {
+				_, err = snapshotter.Prepare(ctx, id, resolvedParent, labelOpt)
+			}
+			if err != nil {
+				return err
+			}
+			c.SnapshotKey = id
+			c.Image = i.Name()
+			return nil
+		}
+
 		if _, err := snapshotter.Stat(ctx, usernsID); err == nil {
 			if _, err := snapshotter.Prepare(ctx, id, usernsID); err == nil {
 				c.SnapshotKey = id
@@ -109,13 +134,22 @@ func withRemappedSnapshotBase(id string, i Image, idmap idtools.IdentityMapping,
 				return err
 			}
 		}
-		mounts, err := snapshotter.Prepare(ctx, usernsID+"-remap", parent)
-		if err != nil {
-			return err
-		}
-		if err := remapRootFS(ctx, mounts, idmap); err != nil {
-			snapshotter.Remove(ctx, usernsID)
-			return err
+
+		if mode == remapModeLabels {
+			// The snapshotter shifts ownership itself given the mapping
+			// labels; no walk needed, just let it materialize the base.
+			if _, err := snapshotter.Prepare(ctx, usernsID+"-remap", resolvedParent, labelOpt); err != nil {
+				return err
+			}
+		} else {
+			mounts, err := snapshotter.Prepare(ctx, usernsID+"-remap", resolvedParent)
+			if err != nil {
+				return err
+			}
+			if err := remapRootFS(ctx, mounts, idmap, opts...); err != nil {
+				snapshotter.Remove(ctx, usernsID)
+				return err
+			}
 		}
 		if err := snapshotter.Commit(ctx, usernsID, usernsID+"-remap"); err != nil {
 			return err
@@ -134,23 +168,102 @@ func withRemappedSnapshotBase(id string, i Image, idmap idtools.IdentityMapping,
 	}
 }
 
-func remapRootFS(ctx context.Context, mounts []mount.Mount, idmap idtools.IdentityMapping) error {
+// RemapOpt configures how a remapped snapshot's ownership is rewritten by
+// remapRootFS.
+type RemapOpt func(*remapConfig)
+
+type remapConfig struct {
+	concurrency int
+}
+
+func newRemapConfig(opts []RemapOpt) *remapConfig {
+	cfg := &remapConfig{concurrency: runtime.GOMAXPROCS(0)}
+	for _, o := range opts {
+		o(cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+	return cfg
+}
+
+// WithRemapConcurrency sets the number of workers used to shift ownership
+// while preparing a remapped snapshot. Lchown is trivially parallel, so this
+// defaults to GOMAXPROCS; pass a smaller n to avoid starving other host I/O.
+func WithRemapConcurrency(n int) RemapOpt {
+	return func(c *remapConfig) { c.concurrency = n }
+}
+
+func remapRootFS(ctx context.Context, mounts []mount.Mount, idmap idtools.IdentityMapping, opts ...RemapOpt) error {
+	cfg := newRemapConfig(opts)
+	if handled, err := tryReflinkRemap(mounts, idmap, cfg); handled {
+		return err
+	}
 	return mount.WithTempMount(ctx, mounts, func(root string) error {
-		return filepath.Walk(root, chown(root, idmap))
+		return remapTree(root, idmap, cfg)
 	})
 }
 
-func chown(root string, idmap idtools.IdentityMapping) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
+// remapTree walks root and Lchowns every entry whose mapped owner differs
+// from what's already on disk, fanned out across cfg.concurrency workers.
+func remapTree(root string, idmap idtools.IdentityMapping, cfg *remapConfig) error {
+	paths := make(chan string, cfg.concurrency*2)
+	errs := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				if err := remapEntry(path, idmap); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	walkErr := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		stat := info.Sys().(*syscall.Stat_t)
-		h, cerr := idmap.ToHost(idtools.Identity{UID: int(stat.Uid), GID: int(stat.Gid)})
-		if cerr != nil {
-			return cerr
+		select {
+		case paths <- path:
+		case err := <-errs:
+			return err
 		}
-		// be sure the lchown the path as to not de-reference the symlink to a host file
-		return os.Lchown(path, h.UID, h.GID)
+		return nil
+	})
+	close(paths)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	return walkErr
+}
+
+func remapEntry(path string, idmap idtools.IdentityMapping) error {
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(path, &stat); err != nil {
+		return err
+	}
+	h, err := idmap.ToHost(idtools.Identity{UID: int(stat.Uid), GID: int(stat.Gid)})
+	if err != nil {
+		return err
+	}
+	if h.UID == int(stat.Uid) && h.GID == int(stat.Gid) {
+		// Already correctly owned on disk; skip the syscall entirely.
+		return nil
 	}
+	// be sure to lchown the path as to not de-reference the symlink to a host file
+	return os.Lchown(path, h.UID, h.GID)
 }
@@ -0,0 +1,279 @@
+//go:build windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/image-spec/identity"
+	"golang.org/x/sys/windows"
+)
+
+// WindowsACE describes one access control entry to apply to every file in a
+// remapped snapshot: an owner (a Windows account name such as
+// "ContainerUser"/"ContainerAdministrator", or a raw SID string) and the
+// access rights to grant it.
+type WindowsACE struct {
+	SID  string
+	Mask windows.ACCESS_MASK
+}
+
+// WithRemappedSnapshotWindows creates a new snapshot and rewrites the
+// security descriptor of every file in it to grant ownerSID read/write/
+// execute access. It is the Windows analogue of WithRemappedSnapshot, which
+// shifts numeric uid/gid ownership on Unix.
+func WithRemappedSnapshotWindows(id string, i Image, ownerSID string) NewContainerOpts {
+	return withRemappedSnapshotWindowsBase(id, i, []WindowsACE{defaultACE(ownerSID)}, false)
+}
+
+// WithRemappedSnapshotWindowsView is similar to WithRemappedSnapshotWindows but rootfs is mounted as read-only.
+func WithRemappedSnapshotWindowsView(id string, i Image, ownerSID string) NewContainerOpts {
+	return withRemappedSnapshotWindowsBase(id, i, []WindowsACE{defaultACE(ownerSID)}, true)
+}
+
+// WithMultiRemappedSnapshotWindows is the multi-entry variant of WithRemappedSnapshotWindows, granting every ACE in aces.
+// Every ACE is applied only by the DACL-rewrite walk: when the snapshotter
+// advertises remap-ids or remap-ids-lazy, only the first ACE's SID is passed
+// to it, as the ownership label, and the other ACEs and all access masks are not.
+func WithMultiRemappedSnapshotWindows(id string, i Image, aces []WindowsACE) NewContainerOpts {
+	return withRemappedSnapshotWindowsBase(id, i, aces, false)
+}
+
+// WithMultiRemappedSnapshotWindowsView is the read-only variant of WithMultiRemappedSnapshotWindows.
+func WithMultiRemappedSnapshotWindowsView(id string, i Image, aces []WindowsACE) NewContainerOpts {
+	return withRemappedSnapshotWindowsBase(id, i, aces, true)
+}
+
+func defaultACE(ownerSID string) WindowsACE {
+	return WindowsACE{
+		SID:  ownerSID,
+		Mask: windows.GENERIC_READ | windows.GENERIC_WRITE | windows.GENERIC_EXECUTE,
+	}
+}
+
+func withRemappedSnapshotWindowsBase(id string, i Image, aces []WindowsACE, readonly bool) NewContainerOpts {
+	return func(ctx context.Context, client *Client, c *containers.Container) error {
+		if len(aces) == 0 {
+			return fmt.Errorf("withRemappedSnapshotWindowsBase: no ACEs given")
+		}
+
+		diffIDs, err := i.(*image).i.RootFS(ctx, client.ContentStore(), client.platform)
+		if err != nil {
+			return err
+		}
+
+		parent := identity.ChainID(diffIDs).String()
+		usernsID := fmt.Sprintf("%s-%s", parent, aceKey(aces))
+
+		c.Snapshotter, err = client.resolveSnapshotterName(ctx, c.Snapshotter)
+		if err != nil {
+			return err
+		}
+		snapshotter, err := client.getSnapshotter(ctx, c.Snapshotter)
+		if err != nil {
+			return err
+		}
+
+		labelOpt := WithRemapperLabelsWindows(aces[0].SID)
+		mode, resolvedParent, err := resolveSnapshotOptions(ctx, client, c.Snapshotter, snapshotter, parent, labelOpt)
+		if err != nil {
+			return err
+		}
+		if mode == remapModeLazy {
+			// The snapshotter can materialize shifted ownership on demand as
+			// it streams content in; skip the prepare/remap/commit dance
+			// entirely and let it apply the mapping label itself.
+			if readonly {
+				_, err = snapshotter.View(ctx, id, resolvedParent, labelOpt)
+			} else {
+				_, err = snapshotter.Prepare(ctx, id, resolvedParent, labelOpt)
+			}
+			if err != nil {
+				return err
+			}
+			c.SnapshotKey = id
+			c.Image = i.Name()
+			return nil
+		}
+
+		if _, err := snapshotter.Stat(ctx, usernsID); err == nil {
+			if readonly {
+				_, err = snapshotter.View(ctx, id, usernsID)
+			} else {
+				_, err = snapshotter.Prepare(ctx, id, usernsID)
+			}
+			if err == nil {
+				c.SnapshotKey = id
+				c.Image = i.Name()
+				return nil
+			} else if !errdefs.IsNotFound(err) {
+				return err
+			}
+		}
+
+		if mode == remapModeLabels {
+			// The snapshotter rewrites ownership itself given the mapping
+			// label; no walk needed, just let it materialize the base.
+			if _, err := snapshotter.Prepare(ctx, usernsID+"-remap", resolvedParent, labelOpt); err != nil {
+				return err
+			}
+		} else {
+			mounts, err := snapshotter.Prepare(ctx, usernsID+"-remap", resolvedParent)
+			if err != nil {
+				return err
+			}
+			if err := remapRootFSWindows(ctx, mounts, aces); err != nil {
+				snapshotter.Remove(ctx, usernsID)
+				return err
+			}
+		}
+		if err := snapshotter.Commit(ctx, usernsID, usernsID+"-remap"); err != nil {
+			return err
+		}
+		if readonly {
+			_, err = snapshotter.View(ctx, id, usernsID)
+		} else {
+			_, err = snapshotter.Prepare(ctx, id, usernsID)
+		}
+		if err != nil {
+			return err
+		}
+		c.SnapshotKey = id
+		c.Image = i.Name()
+		return nil
+	}
+}
+
+// aceKey builds a snapshot key suffix identifying this exact set of ACEs, so
+// that identical owner/ACL requests reuse the same remapped base snapshot.
+func aceKey(aces []WindowsACE) string {
+	parts := make([]string, 0, len(aces))
+	for _, ace := range aces {
+		parts = append(parts, fmt.Sprintf("%s:%x", ace.SID, ace.Mask))
+	}
+	return strings.Join(parts, ",")
+}
+
+func remapRootFSWindows(ctx context.Context, mounts []mount.Mount, aces []WindowsACE) error {
+	resolved, err := resolveACEs(aces)
+	if err != nil {
+		return err
+	}
+	return mount.WithTempMount(ctx, mounts, func(root string) error {
+		return filepath.Walk(root, chownWindows(resolved))
+	})
+}
+
+type resolvedACE struct {
+	sid  *windows.SID
+	mask windows.ACCESS_MASK
+}
+
+func resolveACEs(aces []WindowsACE) ([]resolvedACE, error) {
+	resolved := make([]resolvedACE, 0, len(aces))
+	for _, ace := range aces {
+		sid, err := lookupSID(ace.SID)
+		if err != nil {
+			return nil, fmt.Errorf("resolve owner %q: %w", ace.SID, err)
+		}
+		resolved = append(resolved, resolvedACE{sid: sid, mask: ace.Mask})
+	}
+	return resolved, nil
+}
+
+// lookupSID resolves account, which may already be a SID string
+// (e.g. "S-1-5-93-2-2") or a Windows account name (e.g. "ContainerUser"), to
+// a *windows.SID.
+func lookupSID(account string) (*windows.SID, error) {
+	if sid, err := windows.StringToSid(account); err == nil {
+		return sid, nil
+	}
+	sid, _, _, err := windows.LookupSID("", account)
+	if err != nil {
+		return nil, fmt.Errorf("LookupAccountName %s: %w", account, err)
+	}
+	return sid, nil
+}
+
+// existingDACL reads path's current DACL so chownWindows can merge the new
+// ACEs into it instead of replacing it outright -- mirroring Lchown on Unix,
+// which only ever changes ownership and never touches unrelated permission
+// bits. Without this, SYSTEM/Administrators and any inherited ACEs would be
+// silently dropped the moment a file got remapped.
+func existingDACL(path string) (*windows.ACL, error) {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return nil, err
+	}
+	acl, _, err := sd.DACL()
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// chownWindows is the Windows analogue of chown: instead of an Lchown
+// syscall it rewrites the DACL of every file to grant the resolved ACEs,
+// merging them into the file's existing DACL.
+func chownWindows(aces []resolvedACE) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(aces) == 0 {
+			return fmt.Errorf("chownWindows: no ACEs given for %s", path)
+		}
+		explicit := make([]windows.EXPLICIT_ACCESS, 0, len(aces))
+		for _, ace := range aces {
+			explicit = append(explicit, windows.EXPLICIT_ACCESS{
+				AccessPermissions: ace.mask,
+				AccessMode:        windows.GRANT_ACCESS,
+				Inheritance:       windows.NO_INHERITANCE,
+				Trustee: windows.TRUSTEE{
+					TrusteeForm:  windows.TRUSTEE_IS_SID,
+					TrusteeValue: windows.TrusteeValueFromSID(ace.sid),
+				},
+			})
+		}
+		existing, err := existingDACL(path)
+		if err != nil {
+			return fmt.Errorf("read existing DACL for %s: %w", path, err)
+		}
+		acl, err := windows.ACLFromEntries(explicit, existing)
+		if err != nil {
+			return fmt.Errorf("build DACL for %s: %w", path, err)
+		}
+		return windows.SetNamedSecurityInfo(
+			path,
+			windows.SE_FILE_OBJECT,
+			windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION,
+			aces[0].sid,
+			nil,
+			acl,
+			nil,
+		)
+	}
+}
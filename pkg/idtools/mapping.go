@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package idtools
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MarshalUIDMapLabel and MarshalGIDMapLabel encode one side of an
+// IdentityMapping into the canonical wire format used for snapshot labels:
+// "uidmap=<c>:<h>:<l>,<c>:<h>:<l>" (respectively "gidmap=..."). This is the
+// single encoding snapshotter plugins need to understand, replacing the
+// colon-delimited single range WithRemapperLabels used to emit and the JSON
+// WithMultiRemapperLabels used to emit. snapshots.WithIdentityMapping writes
+// uid and gid data under separate labels (snapshots.LabelSnapshotUIDMapping /
+// LabelSnapshotGIDMapping), which is why there's no combined Marshal/Parse
+// pair here: ParseMappingLabel is the single reader for both.
+func MarshalUIDMapLabel(maps []IDMap) string {
+	var b strings.Builder
+	b.WriteString("uidmap=")
+	writeIDMaps(&b, maps)
+	return b.String()
+}
+
+func MarshalGIDMapLabel(maps []IDMap) string {
+	var b strings.Builder
+	b.WriteString("gidmap=")
+	writeIDMaps(&b, maps)
+	return b.String()
+}
+
+func writeIDMaps(b *strings.Builder, maps []IDMap) {
+	for i, m := range maps {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+	}
+}
+
+// ParseMappingLabel decodes a single snapshot label value into its IDMap
+// list. It understands the canonical "uidmap=..."/"gidmap=..." encoding
+// MarshalUIDMapLabel/MarshalGIDMapLabel produce, and falls back to the two
+// formats WithRemapperLabels (a bare "<ctr>:<host>:<length>" range) and
+// WithMultiRemapperLabels (a JSON array of IDMap) used to emit directly,
+// so a snapshotter can upgrade to this parser without breaking on labels
+// written by a not-yet-upgraded caller during the transition.
+func ParseMappingLabel(s string) ([]IDMap, error) {
+	if v, ok := strings.CutPrefix(s, "uidmap="); ok {
+		return parseIDMaps(v)
+	}
+	if v, ok := strings.CutPrefix(s, "gidmap="); ok {
+		return parseIDMaps(v)
+	}
+	if maps, err := parseIDMaps(s); err == nil {
+		return maps, nil
+	}
+	var maps []IDMap
+	if err := json.Unmarshal([]byte(s), &maps); err == nil {
+		return maps, nil
+	}
+	return nil, fmt.Errorf("idtools: %q is not a recognized id mapping label", s)
+}
+
+func parseIDMaps(s string) ([]IDMap, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	maps := make([]IDMap, 0, len(parts))
+	for _, p := range parts {
+		fields := strings.Split(p, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected <container>:<host>:<length>, got %q", p)
+		}
+		c, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("container id %q: %w", fields[0], err)
+		}
+		h, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("host id %q: %w", fields[1], err)
+		}
+		l, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("length %q: %w", fields[2], err)
+		}
+		maps = append(maps, IDMap{ContainerID: c, HostID: h, Size: l})
+	}
+	return maps, nil
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package idtools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshalParseMappingLabelRoundTrip(t *testing.T) {
+	maps := []IDMap{{ContainerID: 0, HostID: 100000, Size: 1}, {ContainerID: 1, HostID: 1, Size: 999}}
+
+	uid := MarshalUIDMapLabel(maps)
+	if want := "uidmap=0:100000:1,1:1:999"; uid != want {
+		t.Fatalf("MarshalUIDMapLabel(%+v) = %q, want %q", maps, uid, want)
+	}
+	gid := MarshalGIDMapLabel(maps)
+	if want := "gidmap=0:100000:1,1:1:999"; gid != want {
+		t.Fatalf("MarshalGIDMapLabel(%+v) = %q, want %q", maps, gid, want)
+	}
+
+	for _, encoded := range []string{uid, gid} {
+		parsed, err := ParseMappingLabel(encoded)
+		if err != nil {
+			t.Fatalf("ParseMappingLabel(%q): %v", encoded, err)
+		}
+		if !reflect.DeepEqual(parsed, maps) {
+			t.Fatalf("ParseMappingLabel(%q) = %+v, want %+v", encoded, parsed, maps)
+		}
+	}
+}
+
+func TestParseMappingLabelLegacyFormats(t *testing.T) {
+	want := []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+
+	// WithRemapperLabels: a bare "<ctr>:<host>:<length>" range, no prefix.
+	parsed, err := ParseMappingLabel("0:100000:65536")
+	if err != nil {
+		t.Fatalf("ParseMappingLabel(colon-triple): %v", err)
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Fatalf("ParseMappingLabel(colon-triple) = %+v, want %+v", parsed, want)
+	}
+
+	// WithMultiRemapperLabels: a JSON array of IDMap.
+	parsed, err = ParseMappingLabel(`[{"ContainerID":0,"HostID":100000,"Size":65536}]`)
+	if err != nil {
+		t.Fatalf("ParseMappingLabel(json): %v", err)
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Fatalf("ParseMappingLabel(json) = %+v, want %+v", parsed, want)
+	}
+}
+
+func TestParseMappingLabelError(t *testing.T) {
+	if _, err := ParseMappingLabel("not a mapping at all"); err == nil {
+		t.Fatalf("ParseMappingLabel(garbage) = nil error, want error")
+	}
+}
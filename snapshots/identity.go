@@ -0,0 +1,36 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshots
+
+import "github.com/containerd/containerd/pkg/idtools"
+
+// WithIdentityMapping sets the LabelSnapshotUIDMapping and
+// LabelSnapshotGIDMapping labels from idmap, each encoded independently via
+// idtools.MarshalUIDMapLabel/MarshalGIDMapLabel rather than sharing one
+// combined string, so a snapshotter reading only one of the two labels (as
+// the pre-existing WithRemapperLabels/WithMultiRemapperLabels callers did)
+// still gets just its own side of the mapping.
+//
+// idtools.ParseMappingLabel, which understands this encoding as well as the
+// colon-triple and JSON-array encodings those older helpers emitted, is the
+// intended counterpart on the snapshotter side during the migration.
+func WithIdentityMapping(idmap idtools.IdentityMapping) Opt {
+	return WithLabels(map[string]string{
+		LabelSnapshotUIDMapping: idtools.MarshalUIDMapLabel(idmap.UIDMaps),
+		LabelSnapshotGIDMapping: idtools.MarshalGIDMapLabel(idmap.GIDMaps),
+	})
+}
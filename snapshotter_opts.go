@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/snapshots"
+)
+
+const (
+	capabRemapIDs = "remap-ids"
+	// capabRemapIDsLazy is advertised by remote/lazy snapshotters (e.g.
+	// stargz-snapshotter, nydus, zstd:chunked) that can materialize files
+	// with shifted ownership on demand as chunks are fetched, without
+	// needing a full walk up front.
+	capabRemapIDsLazy = "remap-ids-lazy"
+)
+
+// remapMode describes how resolveSnapshotOptions decided to satisfy a
+// requested remapped snapshot, given what the target snapshotter advertises.
+// It's shared by the Unix (idtools.IdentityMapping/chown) and Windows
+// (WindowsACE/DACL) remap paths, since capability negotiation against the
+// snapshotter is identical on both platforms.
+type remapMode int
+
+const (
+	// remapModeWalk means the snapshotter has no remap capability; the
+	// caller must fall back to preparing a throwaway base snapshot and
+	// walking it (the chown/reflink path on Unix, the DACL-rewrite walk on
+	// Windows).
+	remapModeWalk remapMode = iota
+	// remapModeLabels means the snapshotter advertises "remap-ids": it
+	// shifts ownership itself given the mapping labels, so the caller only
+	// needs to Prepare the base with those labels attached, no walk.
+	remapModeLabels
+	// remapModeLazy means the snapshotter advertises "remap-ids-lazy": it
+	// can shift ownership as content streams in, so the caller should pass
+	// the mapping labels straight through to Prepare(id, parent, ...)
+	// without ever preparing or committing an intermediate base snapshot.
+	remapModeLazy
+)
+
+// capabilitySnapshotter is implemented by snapshotters that advertise
+// optional capabilities -- such as remap-ids/remap-ids-lazy -- without
+// changing the snapshots.Snapshotter interface itself.
+type capabilitySnapshotter interface {
+	Capabilities(ctx context.Context) ([]string, error)
+}
+
+// resolveSnapshotOptions negotiates how a remapped snapshot should be
+// prepared against snapshotter: remapModeWalk if it advertises no remap
+// capability, remapModeLabels if it advertises "remap-ids", or
+// remapModeLazy if it advertises "remap-ids-lazy" (preferred when both are
+// present, since it avoids materializing a base snapshot at all). parent is
+// returned unchanged; it's threaded through so callers have a single
+// resolved value to Prepare against regardless of mode.
+func resolveSnapshotOptions(ctx context.Context, client *Client, snapshotterName string, snapshotter snapshots.Snapshotter, parent string, opts ...snapshots.Opt) (remapMode, string, error) {
+	cs, ok := snapshotter.(capabilitySnapshotter)
+	if !ok {
+		return remapModeWalk, parent, nil
+	}
+	caps, err := cs.Capabilities(ctx)
+	if err != nil {
+		return remapModeWalk, parent, nil
+	}
+
+	mode := remapModeWalk
+	for _, c := range caps {
+		switch c {
+		case capabRemapIDsLazy:
+			return remapModeLazy, parent, nil
+		case capabRemapIDs:
+			mode = remapModeLabels
+		}
+	}
+	return mode, parent, nil
+}
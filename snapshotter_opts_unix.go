@@ -19,46 +19,32 @@
 package containerd
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-
 	"github.com/containerd/containerd/pkg/idtools"
 	"github.com/containerd/containerd/snapshots"
 )
 
-const (
-	capabRemapIDs = "remap-ids"
-)
-
 // WithRemapperLabels creates the labels used by any supporting snapshotter
-// to shift the filesystem ownership (user namespace mapping) automatically; currently
-// supported by the fuse-overlayfs snapshotter
+// to shift the filesystem ownership (user namespace mapping) automatically;
+// currently supported by the fuse-overlayfs snapshotter.
+//
+// Deprecated: use snapshots.WithIdentityMapping, which carries a full
+// idtools.IdentityMapping instead of a single uid/gid range.
 func WithRemapperLabels(ctrUID, hostUID, ctrGID, hostGID, length uint32) snapshots.Opt {
-	return snapshots.WithLabels(map[string]string{
-		snapshots.LabelSnapshotUIDMapping: fmt.Sprintf("%d:%d:%d", ctrUID, hostUID, length),
-		snapshots.LabelSnapshotGIDMapping: fmt.Sprintf("%d:%d:%d", ctrGID, hostGID, length)})
+	return snapshots.WithIdentityMapping(idtools.IdentityMapping{
+		UIDMaps: []idtools.IDMap{{ContainerID: int(ctrUID), HostID: int(hostUID), Size: int(length)}},
+		GIDMaps: []idtools.IDMap{{ContainerID: int(ctrGID), HostID: int(hostGID), Size: int(length)}},
+	})
 }
 
+// WithMultiRemapperLabels creates the labels used by any supporting
+// snapshotter to shift filesystem ownership according to idmap.
+//
+// Deprecated: use snapshots.WithIdentityMapping.
 func WithMultiRemapperLabels(idmap idtools.IdentityMapping) snapshots.Opt {
-	uidMap, err := json.Marshal(idmap.UIDMaps)
-	if err != nil {
-		return snapshots.WithLabels(map[string]string{})
-	}
-
-	gidMap, err := json.Marshal(idmap.GIDMaps)
-	if err != nil {
-		return snapshots.WithLabels(map[string]string{})
-	}
-
-	return snapshots.WithLabels(map[string]string{
-		snapshots.LabelSnapshotUIDMapping: string(uidMap),
-		snapshots.LabelSnapshotGIDMapping: string(gidMap),
-	})
-
+	return snapshots.WithIdentityMapping(idmap)
 }
 
-func resolveSnapshotOptions(ctx context.Context, client *Client, snapshotterName string, snapshotter snapshots.Snapshotter, parent string, opts ...snapshots.Opt) (string, error) {
-	// Snapshotter supports ID remapping, we don't need to do anything.
-	return parent, nil
-}
+// resolveSnapshotOptions, remapMode, and capabilitySnapshotter are declared
+// in snapshotter_opts.go: the capability negotiation they implement doesn't
+// depend on the platform, only the remap mechanism the caller falls back to
+// does (chown/reflink here vs. DACL rewrite on Windows).
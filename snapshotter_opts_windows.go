@@ -0,0 +1,37 @@
+//go:build windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package containerd
+
+import (
+	"github.com/containerd/containerd/snapshots"
+)
+
+// WithRemapperLabelsWindows creates the labels used by any supporting
+// Windows snapshotter (hcs/wcow) to shift file ownership to ownerSID
+// automatically, mirroring WithRemapperLabels on Unix.
+//
+// resolveSnapshotOptions (shared with Unix; see snapshotter_opts.go)
+// negotiates whether a snapshotter actually understands these labels before
+// withRemappedSnapshotWindowsBase relies on them instead of its DACL-rewrite
+// walk.
+func WithRemapperLabelsWindows(ownerSID string) snapshots.Opt {
+	return snapshots.WithLabels(map[string]string{
+		snapshots.LabelSnapshotUIDMapping: ownerSID,
+	})
+}